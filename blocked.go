@@ -0,0 +1,195 @@
+package bloomfilter
+
+// TODO SIMD-friendly block layout for AVX2 gather/scatter
+
+import (
+  "bytes"
+  "encoding/binary"
+  "hash/crc32"
+  "io"
+  "math/bits"
+
+  "github.com/steakknife/hamming"
+)
+
+const (
+  blockedBlockBits = 512                       // one 64-byte CPU cache line
+  blockedBlockMask = blockedBlockBits - 1       // mask to the 9 bits within a block
+  blockedWordsPerBlock = blockedBlockBits / 64  // 8
+)
+
+// BlockedFilter is a cache-line-blocked Bloom filter: bits are partitioned
+// into 512-bit (64-byte) blocks, the raw hash selects a single block, and
+// each of the k keys sets/tests one bit only within that block. Every Add and
+// Contains therefore touches exactly one cache line, at the cost of a
+// roughly 1.5-2x higher false positive probability than a classic Filter
+// with the same m and k.
+type BlockedFilter struct {
+  bits      []uint64
+  keys      []uint64
+  m         uint64 // number of bits, rounded up to a whole number of blocks
+  numBlocks uint64
+  n         uint64
+}
+
+// m is the requested size of the filter in bits, >= 2 (rounded up to a whole block)
+//
+// k is the number of keys used per element, >= 1
+func NewBlocked(m, k uint64) *BlockedFilter {
+  if m <= 1 {
+    panic("m (number of bits in the bloom filter) must be > 1")
+  }
+  if k == 0 {
+    panic("k (number of keys uses in the bloom filter) must be > 0")
+  }
+  numBlocks := (m + blockedBlockBits - 1) / blockedBlockBits
+  return &BlockedFilter{
+    numBlocks: numBlocks,
+    m:         numBlocks * blockedBlockBits,
+    bits:      make([]uint64, numBlocks*blockedWordsPerBlock),
+    keys:      newKeys(k),
+  }
+}
+
+// ToBlocked converts f into an empty BlockedFilter sized for the same
+// capacity and key count. The conversion is lossy: the two filters use
+// incompatible bit layouts, so the caller must re-Add every element.
+func (f Filter) ToBlocked() *BlockedFilter {
+  return NewBlocked(f.m, f.K())
+}
+
+// blockIndex picks a block for rawHash via Lemire's fast range reduction:
+// (rawHash * numBlocks) >> 64, i.e. the high 64 bits of the 128-bit product.
+func (f BlockedFilter) blockIndex(rawHash uint64) uint64 {
+  hi, _ := bits.Mul64(rawHash, f.numBlocks)
+  return hi
+}
+
+func (f BlockedFilter) M() uint64 {
+  return f.m
+}
+
+func (f BlockedFilter) K() uint64 {
+  return uint64(len(f.keys))
+}
+
+func (f BlockedFilter) N() uint64 {
+  return f.n
+}
+
+func (f *BlockedFilter) Add(v Hashable) {
+  rawHash := v.BloomFilterHash()
+  base := f.blockIndex(rawHash) * blockedWordsPerBlock
+  for _, key := range f.keys {
+    pos := (rawHash ^ key) & blockedBlockMask
+    f.bits[base+(pos>>6)] |= 1 << uint(pos&0x3f)
+  }
+  f.n++
+}
+
+// false: definitely false
+// true:  maybe true or false
+func (f BlockedFilter) Contains(v Hashable) bool {
+  rawHash := v.BloomFilterHash()
+  base := f.blockIndex(rawHash) * blockedWordsPerBlock
+  for _, key := range f.keys {
+    pos := (rawHash ^ key) & blockedBlockMask
+    if f.bits[base+(pos>>6)]&(1<<uint(pos&0x3f)) == 0 {
+      return false
+    }
+  }
+  return true // maybe
+}
+
+// exhaustive count # of 1's
+func (f BlockedFilter) PreciseFilledRatio() float64 {
+  ones := 0
+  for _, b := range f.bits {
+    ones += hamming.CountBitsUint64(b)
+  }
+  return float64(ones) / float64(f.m)
+}
+
+// on-disk layout: the shared header (flagBlocked) from writeFrameHeader,
+// then keys, then bits, then a CRC32C of everything above. See Filter.WriteTo.
+func (f BlockedFilter) WriteTo(w io.Writer) (written int64, err error) {
+  crc := crc32.New(crc32cTable)
+  mw := io.MultiWriter(w, crc)
+
+  if err = writeFrameHeader(mw, flagBlocked, f.m, f.n, uint32(f.K())); err != nil {
+    return
+  }
+  written += frameHeaderSize
+
+  if err = binary.Write(mw, binary.LittleEndian, f.keys); err != nil {
+    return
+  }
+  written += int64(len(f.keys)) * 8
+
+  if err = binary.Write(mw, binary.LittleEndian, f.bits); err != nil {
+    return
+  }
+  written += int64(len(f.bits)) * 8
+
+  if err = binary.Write(w, binary.LittleEndian, crc.Sum32()); err != nil {
+    return
+  }
+  written += 4
+
+  return
+}
+
+func (f *BlockedFilter) ReadFrom(r io.Reader) (read int64, err error) {
+  crc := crc32.New(crc32cTable)
+  tr := io.TeeReader(r, crc)
+
+  var flags uint8
+  var k uint32
+  flags, f.m, f.n, k, err = readFrameHeader(tr)
+  if err != nil {
+    return
+  }
+  read += frameHeaderSize
+  if flags != flagBlocked {
+    err = ErrIncompatibleVersion
+    return
+  }
+
+  f.keys = make([]uint64, k)
+  if err = binary.Read(tr, binary.LittleEndian, f.keys); err != nil {
+    return
+  }
+  read += int64(k) * 8
+
+  f.numBlocks = (f.m + blockedBlockBits - 1) / blockedBlockBits
+  f.bits = make([]uint64, f.numBlocks*blockedWordsPerBlock)
+  if err = binary.Read(tr, binary.LittleEndian, f.bits); err != nil {
+    return
+  }
+  read += int64(len(f.bits)) * 8
+
+  var wantSum uint32
+  if err = binary.Read(r, binary.LittleEndian, &wantSum); err != nil {
+    return
+  }
+  read += 4
+
+  if crc.Sum32() != wantSum {
+    err = ErrChecksumMismatch
+    return
+  }
+
+  return
+}
+
+func (f BlockedFilter) MarshalBinary() (data []byte, err error) {
+  buf := new(bytes.Buffer)
+  _, err = f.WriteTo(buf)
+  data = buf.Bytes()
+  return
+}
+
+func (f *BlockedFilter) UnmarshalBinary(data []byte) (err error) {
+  _, err = f.ReadFrom(bytes.NewReader(data))
+  return
+}
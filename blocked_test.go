@@ -0,0 +1,137 @@
+package bloomfilter
+
+import (
+  "encoding/binary"
+  "testing"
+)
+
+func TestBlockedContainsAfterAdd(t *testing.T) {
+  f := NewBlocked(100000, 6)
+  for i := uint64(0); i < 500; i++ {
+    f.Add(testHashable(i))
+  }
+  for i := uint64(0); i < 500; i++ {
+    if !f.Contains(testHashable(i)) {
+      t.Fatalf("expected Contains(%d) to be true after Add", i)
+    }
+  }
+}
+
+func TestFilterToBlocked(t *testing.T) {
+  f := New(100000, 6)
+  blocked := f.ToBlocked()
+  if blocked.K() != f.K() {
+    t.Fatalf("ToBlocked changed k: got %d, want %d", blocked.K(), f.K())
+  }
+  if blocked.M() < f.M() || blocked.M()%blockedBlockBits != 0 {
+    t.Fatalf("ToBlocked's m (%d) should round f.M() (%d) up to a whole block", blocked.M(), f.M())
+  }
+}
+
+func TestBlockedMarshalRoundTrip(t *testing.T) {
+  f := NewBlocked(100000, 6)
+  for i := uint64(0); i < 500; i++ {
+    f.Add(testHashable(i))
+  }
+
+  data, err := f.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+
+  var got BlockedFilter
+  if err := got.UnmarshalBinary(data); err != nil {
+    t.Fatalf("UnmarshalBinary: %v", err)
+  }
+
+  for i := uint64(0); i < 500; i++ {
+    if !got.Contains(testHashable(i)) {
+      t.Fatalf("expected Contains(%d) to be true after round-trip", i)
+    }
+  }
+}
+
+// TestBlockedReadFromRejectsImplausibleHeader is BlockedFilter's share of
+// the readFrameHeader OOM regression: BlockedFilter.ReadFrom sizes its
+// backing bits from the same wire m as Filter.ReadFrom, so it reproduces
+// the identical crash on a corrupted header. See
+// TestFilterReadFromRejectsImplausibleHeader.
+func TestBlockedReadFromRejectsImplausibleHeader(t *testing.T) {
+  f := NewBlocked(1000, 5)
+  data, err := f.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+
+  const mOffset = 4 + 2 + 1
+  binary.LittleEndian.PutUint64(data[mOffset:], 1<<40)
+
+  var got BlockedFilter
+  if err := got.UnmarshalBinary(data); err != ErrFrameTooLarge {
+    t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+  }
+}
+
+// classicVsBlockedSizes spans 1-100 MiB of underlying bit storage (8 bits/byte).
+var classicVsBlockedSizes = []struct {
+  name  string
+  mBits uint64
+}{
+  {"1MiB", 1 << 23},
+  {"10MiB", 10 << 23},
+  {"100MiB", 100 << 23},
+}
+
+func BenchmarkClassicAdd(b *testing.B) {
+  for _, sz := range classicVsBlockedSizes {
+    b.Run(sz.name, func(b *testing.B) {
+      f := New(sz.mBits, 7)
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        f.Add(testHashable(i))
+      }
+    })
+  }
+}
+
+func BenchmarkBlockedAdd(b *testing.B) {
+  for _, sz := range classicVsBlockedSizes {
+    b.Run(sz.name, func(b *testing.B) {
+      f := NewBlocked(sz.mBits, 7)
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        f.Add(testHashable(i))
+      }
+    })
+  }
+}
+
+func BenchmarkClassicContains(b *testing.B) {
+  for _, sz := range classicVsBlockedSizes {
+    b.Run(sz.name, func(b *testing.B) {
+      f := New(sz.mBits, 7)
+      for i := 0; i < 1<<16; i++ {
+        f.Add(testHashable(i))
+      }
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        f.Contains(testHashable(i))
+      }
+    })
+  }
+}
+
+func BenchmarkBlockedContains(b *testing.B) {
+  for _, sz := range classicVsBlockedSizes {
+    b.Run(sz.name, func(b *testing.B) {
+      f := NewBlocked(sz.mBits, 7)
+      for i := 0; i < 1<<16; i++ {
+        f.Add(testHashable(i))
+      }
+      b.ResetTimer()
+      for i := 0; i < b.N; i++ {
+        f.Contains(testHashable(i))
+      }
+    })
+  }
+}
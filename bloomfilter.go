@@ -7,6 +7,8 @@ import (
   "encoding/binary"
   "errors"
   "github.com/steakknife/hamming"
+  "hash/crc32"
+  "io"
   "math"
   "math/rand"
   "time"
@@ -16,6 +18,36 @@ const (
   randSeedMagic int64 = 0x3f4a61e5b9c0278d
 )
 
+// on-disk framing for Filter.WriteTo / ReadFrom
+const (
+  formatMagic   = "BLMF"
+  formatVersion uint16 = 1
+)
+
+var (
+  ErrChecksumMismatch    = errors.New("bloomfilter: checksum mismatch")
+  ErrIncompatibleVersion = errors.New("bloomfilter: incompatible format version")
+  ErrFrameTooLarge       = errors.New("bloomfilter: frame header declares an implausibly large m or k")
+)
+
+// Sanity bounds on the m/k a frame header is allowed to declare. Without
+// these, a corrupted or adversarial header (e.g. m = 1<<40) would size a
+// make() before the trailing checksum is ever checked, crashing the process
+// with an unrecoverable OOM instead of returning ErrChecksumMismatch.
+const (
+  maxAllowedM uint64 = 1 << 34 // ~2 GiB of backing bits; far beyond any sane filter
+  maxAllowedK uint64 = 1 << 16 // no sane filter needs anywhere near this many keys
+
+  // maxAllowedPackedBytes bounds any single packed allocation sized off a
+  // frame header (e.g. CountingFilter's per-slot counters, which can run
+  // wider than the 1-bit-per-m that maxAllowedM was sized for) to the same
+  // ~2 GiB order of magnitude, so a wide counter width can't multiply a
+  // within-bounds m into an OOM.
+  maxAllowedPackedBytes uint64 = 1 << 31
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Hashable interface {
   BloomFilterHash() uint64
 }
@@ -67,15 +99,85 @@ func newKeys(k uint64) (keys []uint64) {
 
 // Hashable -> hashes
 func (f Filter) hash(v Hashable) (hashes []uint64) {
+  return hashPositions(f.keys, v)
+}
+
+// hashPositions derives len(keys) probe positions (before the final mod m)
+// from a Hashable's single raw hash via Kirsch-Mitzenmacher double hashing:
+// pos_i = h1 + i*h2 + i*i, where h1 salts the raw hash with the filter's
+// first key (so two filters built with identical keys still probe
+// identical positions) and h2 is derived from the raw hash via a fixed
+// mixing constant. This simulates k independent hashes from one, without
+// the correlation that came from XOR-ing the same raw hash with k
+// independent keys. Shared by Filter and any other filter variant that
+// wants the same key-mixing scheme.
+func hashPositions(keys []uint64, v Hashable) (hashes []uint64) {
   rawHash := v.BloomFilterHash()
-  n := len(f.keys)
-  hashes = make([]uint64, n, n)
-  for i := 0; i < n; i++ {
-    hashes[i] = rawHash ^ f.keys[i]
+  return kirschMitzenmacher(len(keys), rawHash^keys[0], mix64(rawHash))
+}
+
+// kirschMitzenmacher expands two independent hashes into k probe positions.
+// See Kirsch & Mitzenmacher, "Less Hashing, Same Performance".
+func kirschMitzenmacher(k int, h1, h2 uint64) (hashes []uint64) {
+  hashes = make([]uint64, k)
+  for i := 0; i < k; i++ {
+    hashes[i] = h1 + uint64(i)*h2 + uint64(i*i)
   }
   return
 }
 
+// mix64 is the splitmix64 finalizer, used as a fixed-constant avalanche
+// step to derive a second, decorrelated hash from a single raw hash.
+func mix64(x uint64) uint64 {
+  x ^= x >> 33
+  x *= 0xff51afd7ed558ccd
+  x ^= x >> 33
+  x *= 0xc4ceb9fe1a85ec53
+  x ^= x >> 33
+  return x
+}
+
+const (
+  fnvOffset64 = 14695981039346656037
+  fnvPrime64  = 1099511628211
+)
+
+// fnv1a64 is FNV-1a, used to turn an arbitrary []byte into the raw 64-bit
+// hash that hashBytes then expands via the same double-hashing as hash.
+func fnv1a64(data []byte) uint64 {
+  h := uint64(fnvOffset64)
+  for _, b := range data {
+    h ^= uint64(b)
+    h *= fnvPrime64
+  }
+  return h
+}
+
+func (f Filter) hashBytes(data []byte) []uint64 {
+  rawHash := fnv1a64(data)
+  return kirschMitzenmacher(len(f.keys), rawHash^f.keys[0], mix64(rawHash))
+}
+
+// AddBytes is the []byte counterpart of Add, for callers who'd rather hash
+// raw bytes than implement Hashable.
+func (f *Filter) AddBytes(data []byte) {
+  for _, h := range f.hashBytes(data) {
+    f.setBit(h)
+  }
+  f.n++
+}
+
+// false: definitely false
+// true:  maybe true or false
+func (f Filter) ContainsBytes(data []byte) bool {
+  for _, h := range f.hashBytes(data) {
+    if !f.getBit(h) {
+      return false
+    }
+  }
+  return true // maybe
+}
+
 func (f Filter) IsCompatible(f2 Filter) bool {
   if f.M() != f2.M() || f.K() != f2.K() {
     return false
@@ -106,6 +208,7 @@ func (f Filter) Union(f2 Filter) (out *Filter, err error) {
     return
   }
   out = f.Copy()
+  out.n = f.n + f2.n
   for i, x := range f2.bits {
     out.bits[i] |= x
   }
@@ -126,89 +229,176 @@ func (f Filter) FalsePosititveProbability() float64 {
   return math.Pow(1.0-math.Exp(float64(-f.K())*(float64(f.N())+0.5)/float64(f.M()-1)), float64(f.K()))
 }
 
-// marshalled binary layout:
+// on-disk header shared by Filter, BlockedFilter, and CountingFilter, each
+// written and checked incrementally against a running CRC32C:
 //
-//   k
-//   n
-//   m
-//   keys
-//   bits
+//   magic     [4]byte ("BLMF")
+//   version   uint16
+//   flags     uint8   (flagCounting / flagBlocked; 0 for a plain Filter)
+//   m         uint64
+//   n         uint64
+//   k         uint32
+//   ... variant-specific fields (e.g. CountingFilter's width), then keys, then
+//       the bit/counter payload ...
+//   checksum  uint32  (CRC32C of everything above)
 //
-func (f Filter) MarshalBinary() (data []byte, err error) {
-  k := f.K()
+const frameHeaderSize = int64(len(formatMagic)) + 2 + 1 + 8 + 8 + 4
 
-  size := binary.Size(k) + binary.Size(f.n) + binary.Size(f.m) + binary.Size(f.keys) + binary.Size(f.bits)
-  data = make([]byte, 0, size)
-  buf := bytes.NewBuffer(data)
+// flags for the header byte shared by every filter variant's wire format
+const (
+  flagCounting uint8 = 1 << 0
+  flagBlocked  uint8 = 1 << 1
+)
 
-  err = binary.Write(buf, binary.LittleEndian, k)
-  if err != nil {
+func writeFrameHeader(w io.Writer, flags uint8, m, n uint64, k uint32) (err error) {
+  for _, field := range []interface{}{[]byte(formatMagic), formatVersion, flags, m, n, k} {
+    if err = binary.Write(w, binary.LittleEndian, field); err != nil {
+      return
+    }
+  }
+  return nil
+}
+
+func readFrameHeader(r io.Reader) (flags uint8, m, n uint64, k uint32, err error) {
+  magic := make([]byte, len(formatMagic))
+  if _, err = io.ReadFull(r, magic); err != nil {
+    return
+  }
+  if string(magic) != formatMagic {
+    err = ErrIncompatibleVersion
     return
   }
 
-  err = binary.Write(buf, binary.LittleEndian, f.n)
-  if err != nil {
+  var version uint16
+  if err = binary.Read(r, binary.LittleEndian, &version); err != nil {
+    return
+  }
+  if version != formatVersion {
+    err = ErrIncompatibleVersion
     return
   }
 
-  err = binary.Write(buf, binary.LittleEndian, f.m)
-  if err != nil {
+  if err = binary.Read(r, binary.LittleEndian, &flags); err != nil {
+    return
+  }
+  if err = binary.Read(r, binary.LittleEndian, &m); err != nil {
+    return
+  }
+  if err = binary.Read(r, binary.LittleEndian, &n); err != nil {
+    return
+  }
+  if err = binary.Read(r, binary.LittleEndian, &k); err != nil {
     return
   }
 
-  err = binary.Write(buf, binary.LittleEndian, f.keys)
-  if err != nil {
+  if m > maxAllowedM || uint64(k) > maxAllowedK {
+    err = ErrFrameTooLarge
+  }
+  return
+}
+
+func (f Filter) WriteTo(w io.Writer) (written int64, err error) {
+  crc := crc32.New(crc32cTable)
+  mw := io.MultiWriter(w, crc)
+
+  if err = writeFrameHeader(mw, 0, f.m, f.n, uint32(f.K())); err != nil {
     return
   }
+  written += frameHeaderSize
 
-  err = binary.Write(buf, binary.LittleEndian, f.bits)
-  if err != nil {
+  if err = binary.Write(mw, binary.LittleEndian, f.keys); err != nil {
     return
   }
+  written += int64(len(f.keys)) * 8
+
+  if err = binary.Write(mw, binary.LittleEndian, f.bits); err != nil {
+    return
+  }
+  written += int64(len(f.bits)) * 8
+
+  if err = binary.Write(w, binary.LittleEndian, crc.Sum32()); err != nil {
+    return
+  }
+  written += 4
 
-  data = buf.Bytes()
   return
 }
 
-func (f *Filter) UnmarshalBinary(data []byte) (err error) {
-  var k uint32
+func (f *Filter) ReadFrom(r io.Reader) (read int64, err error) {
+  crc := crc32.New(crc32cTable)
+  tr := io.TeeReader(r, crc)
 
-  buf := bytes.NewBuffer(data)
-  err = binary.Read(buf, binary.LittleEndian, k)
+  var flags uint8
+  var k uint32
+  flags, f.m, f.n, k, err = readFrameHeader(tr)
   if err != nil {
     return
   }
+  read += frameHeaderSize
+  if flags != 0 {
+    err = ErrIncompatibleVersion
+    return
+  }
 
-  err = binary.Read(buf, binary.LittleEndian, f.n)
-  if err != nil {
+  f.keys = make([]uint64, k)
+  if err = binary.Read(tr, binary.LittleEndian, f.keys); err != nil {
     return
   }
+  read += int64(k) * 8
 
-  err = binary.Read(buf, binary.LittleEndian, f.m)
-  if err != nil {
+  f.bits = make([]uint64, (f.m+63)>>6)
+  if err = binary.Read(tr, binary.LittleEndian, f.bits); err != nil {
     return
   }
+  read += int64(len(f.bits)) * 8
 
-  f.keys = make([]uint64, k, k)
-  err = binary.Read(buf, binary.LittleEndian, f.keys)
-  if err != nil {
+  var wantSum uint32
+  if err = binary.Read(r, binary.LittleEndian, &wantSum); err != nil {
     return
   }
+  read += 4
 
-  f.bits = make([]uint64, f.n, f.n)
-  err = binary.Read(buf, binary.LittleEndian, f.bits)
-  if err != nil {
+  if crc.Sum32() != wantSum {
+    err = ErrChecksumMismatch
     return
   }
 
-  return nil
+  return
+}
+
+func (f Filter) MarshalBinary() (data []byte, err error) {
+  buf := new(bytes.Buffer)
+  _, err = f.WriteTo(buf)
+  data = buf.Bytes()
+  return
+}
+
+func (f *Filter) UnmarshalBinary(data []byte) (err error) {
+  _, err = f.ReadFrom(bytes.NewReader(data))
+  return
+}
+
+// Positions returns the raw probe positions (before the final mod m)
+// Add/Contains would compute for v. Callers that want to warm the cache
+// ahead of a batch of upcoming lookups (e.g. sync.SyncFilter.Prefetch) use
+// this to get values to pass to Touch.
+func (f Filter) Positions(v Hashable) []uint64 {
+  return f.hash(v)
+}
+
+// Touch reads the word backing bit i (mod m) and discards it. Go has no
+// stdlib prefetch intrinsic, so this is a best-effort software prefetch
+// hint: call it ahead of a real lookup on i to warm the cache line the
+// lookup will need.
+func (f Filter) Touch(i uint64) {
+  _ = f.getBit(i)
 }
 
 func (f Filter) getBit(i uint64) bool {
   if i >= f.m {
     i %= f.m
   }
-  return (f.bits[i>>6] >> uint(i&0x3f)) != 0
+  return (f.bits[i>>6]>>uint(i&0x3f))&1 != 0
 }
 
 func (f *Filter) setBit(i uint64) {
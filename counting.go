@@ -0,0 +1,326 @@
+package bloomfilter
+
+// TODO saturating vs wrapping counter overflow policy should be configurable
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "hash/crc32"
+  "io"
+)
+
+// counter widths supported by CountingFilter, in bits per slot
+const (
+  CounterWidth4  uint8 = 4
+  CounterWidth8  uint8 = 8
+  CounterWidth16 uint8 = 16
+)
+
+// CountingFilter is a Bloom filter that replaces the single-bit array with
+// fixed-width saturating counters, so elements can be Removed as well as
+// Added. It reuses Filter's key-mixing scheme, so a CountingFilter and a
+// Filter built with the same m and keys probe identical positions.
+type CountingFilter struct {
+  counters []uint16 // only the low `width` bits of each slot are ever used
+  keys     []uint64
+  width    uint8
+  m        uint64 // number of counter slots
+  n        uint64 // number of inserted elements
+}
+
+// m is the number of counter slots, >= 2
+//
+// k is the number of keys used per element, >= 1
+//
+// width is the number of bits per counter: 4, 8, or 16
+func NewCounting(m, k uint64, width uint8) *CountingFilter {
+  if m <= 1 {
+    panic("m (number of counters in the bloom filter) must be > 1")
+  }
+  if k == 0 {
+    panic("k (number of keys uses in the bloom filter) must be > 0")
+  }
+  switch width {
+  case CounterWidth4, CounterWidth8, CounterWidth16:
+  default:
+    panic("width (bits per counter) must be 4, 8, or 16")
+  }
+  return &CountingFilter{
+    m:        m,
+    width:    width,
+    counters: make([]uint16, m),
+    keys:     newKeys(k),
+  }
+}
+
+func (f CountingFilter) maxCounter() uint16 {
+  return uint16(1)<<f.width - 1
+}
+
+func (f CountingFilter) M() uint64 {
+  return f.m
+}
+
+func (f CountingFilter) K() uint64 {
+  return uint64(len(f.keys))
+}
+
+func (f CountingFilter) N() uint64 {
+  return f.n
+}
+
+func (f CountingFilter) Width() uint8 {
+  return f.width
+}
+
+func (f *CountingFilter) Add(v Hashable) {
+  max := f.maxCounter()
+  for _, h := range hashPositions(f.keys, v) {
+    i := h % f.m
+    if f.counters[i] < max {
+      f.counters[i]++
+    }
+  }
+  f.n++
+}
+
+// Remove decrements the k counters for v. It is only safe to call for
+// values that were actually Added: removing a value that was never
+// inserted can zero out a counter shared with a value that was, causing
+// false negatives.
+func (f *CountingFilter) Remove(v Hashable) {
+  for _, h := range hashPositions(f.keys, v) {
+    i := h % f.m
+    if f.counters[i] > 0 {
+      f.counters[i]--
+    }
+  }
+  if f.n > 0 {
+    f.n--
+  }
+}
+
+// Count estimates how many times v has been inserted, as the minimum of
+// its k counters.
+func (f CountingFilter) Count(v Hashable) uint64 {
+  min := f.maxCounter()
+  for _, h := range hashPositions(f.keys, v) {
+    i := h % f.m
+    if f.counters[i] < min {
+      min = f.counters[i]
+    }
+  }
+  return uint64(min)
+}
+
+// false: definitely false
+// true:  maybe true or false
+func (f CountingFilter) Contains(v Hashable) bool {
+  return f.Count(v) > 0
+}
+
+// Decay halves every counter (Morris-style aging), so that elements not
+// re-Added eventually age out. Useful for sliding-window dedup.
+func (f *CountingFilter) Decay() {
+  for i, c := range f.counters {
+    f.counters[i] = c / 2
+  }
+}
+
+// ToBloom converts f to a standard Filter by thresholding every counter
+// at > 0. The result shares f's m and keys, so it probes the same
+// positions.
+func (f CountingFilter) ToBloom() *Filter {
+  out := &Filter{
+    m:    f.m,
+    n:    f.n,
+    keys: make([]uint64, len(f.keys)),
+    bits: make([]uint64, (f.m+63)>>6),
+  }
+  copy(out.keys, f.keys)
+  for i, c := range f.counters {
+    if c > 0 {
+      out.setBit(uint64(i))
+    }
+  }
+  return out
+}
+
+func packedCounterLen(m uint64, width uint8) uint64 {
+  switch width {
+  case CounterWidth16:
+    return m * 2
+  case CounterWidth8:
+    return m
+  default: // CounterWidth4
+    return (m + 1) / 2
+  }
+}
+
+func packCounters(counters []uint16, width uint8) []byte {
+  switch width {
+  case CounterWidth16:
+    out := make([]byte, len(counters)*2)
+    for i, c := range counters {
+      binary.LittleEndian.PutUint16(out[i*2:], c)
+    }
+    return out
+  case CounterWidth8:
+    out := make([]byte, len(counters))
+    for i, c := range counters {
+      out[i] = byte(c)
+    }
+    return out
+  default: // CounterWidth4
+    out := make([]byte, (len(counters)+1)/2)
+    for i, c := range counters {
+      if i%2 == 0 {
+        out[i/2] |= byte(c) & 0x0f
+      } else {
+        out[i/2] |= byte(c) << 4
+      }
+    }
+    return out
+  }
+}
+
+func unpackCounters(packed []byte, m uint64, width uint8) []uint16 {
+  counters := make([]uint16, m)
+  switch width {
+  case CounterWidth16:
+    for i := range counters {
+      counters[i] = binary.LittleEndian.Uint16(packed[i*2:])
+    }
+  case CounterWidth8:
+    for i := range counters {
+      counters[i] = uint16(packed[i])
+    }
+  default: // CounterWidth4
+    for i := range counters {
+      b := packed[i/2]
+      if i%2 == 0 {
+        counters[i] = uint16(b & 0x0f)
+      } else {
+        counters[i] = uint16(b >> 4)
+      }
+    }
+  }
+  return counters
+}
+
+// on-disk layout: the shared header (flagCounting) from writeFrameHeader,
+// then width, then keys, then the packed counters, then a CRC32C of
+// everything above. See Filter.WriteTo.
+func (f CountingFilter) WriteTo(w io.Writer) (written int64, err error) {
+  crc := crc32.New(crc32cTable)
+  mw := io.MultiWriter(w, crc)
+
+  if err = writeFrameHeader(mw, flagCounting, f.m, f.n, uint32(f.K())); err != nil {
+    return
+  }
+  written += frameHeaderSize
+
+  if err = binary.Write(mw, binary.LittleEndian, f.width); err != nil {
+    return
+  }
+  written++
+
+  if err = binary.Write(mw, binary.LittleEndian, f.keys); err != nil {
+    return
+  }
+  written += int64(len(f.keys)) * 8
+
+  packed := packCounters(f.counters, f.width)
+  if err = binary.Write(mw, binary.LittleEndian, packed); err != nil {
+    return
+  }
+  written += int64(len(packed))
+
+  if err = binary.Write(w, binary.LittleEndian, crc.Sum32()); err != nil {
+    return
+  }
+  written += 4
+
+  return
+}
+
+func (f *CountingFilter) ReadFrom(r io.Reader) (read int64, err error) {
+  crc := crc32.New(crc32cTable)
+  tr := io.TeeReader(r, crc)
+
+  var flags uint8
+  var k uint32
+  flags, f.m, f.n, k, err = readFrameHeader(tr)
+  if err != nil {
+    return
+  }
+  read += frameHeaderSize
+  if flags != flagCounting {
+    err = ErrIncompatibleVersion
+    return
+  }
+
+  if err = binary.Read(tr, binary.LittleEndian, &f.width); err != nil {
+    return
+  }
+  read++
+  switch f.width {
+  case CounterWidth4, CounterWidth8, CounterWidth16:
+  default:
+    err = errors.New("bloomfilter: unsupported counter width")
+    return
+  }
+
+  f.keys = make([]uint64, k)
+  if err = binary.Read(tr, binary.LittleEndian, f.keys); err != nil {
+    return
+  }
+  read += int64(k) * 8
+
+  // unpackCounters always decodes into a []uint16 (2 bytes/counter)
+  // regardless of width, so that decoded allocation - not just the
+  // wire-packed one below - must be bounded before it's sized off f.m.
+  if f.m*2 > maxAllowedPackedBytes {
+    err = ErrFrameTooLarge
+    return
+  }
+
+  packedLen := packedCounterLen(f.m, f.width)
+  if packedLen > maxAllowedPackedBytes {
+    err = ErrFrameTooLarge
+    return
+  }
+
+  packed := make([]byte, packedLen)
+  if _, err = io.ReadFull(tr, packed); err != nil {
+    return
+  }
+  read += int64(len(packed))
+  f.counters = unpackCounters(packed, f.m, f.width)
+
+  var wantSum uint32
+  if err = binary.Read(r, binary.LittleEndian, &wantSum); err != nil {
+    return
+  }
+  read += 4
+
+  if crc.Sum32() != wantSum {
+    err = ErrChecksumMismatch
+    return
+  }
+
+  return
+}
+
+func (f CountingFilter) MarshalBinary() (data []byte, err error) {
+  buf := new(bytes.Buffer)
+  _, err = f.WriteTo(buf)
+  data = buf.Bytes()
+  return
+}
+
+func (f *CountingFilter) UnmarshalBinary(data []byte) (err error) {
+  _, err = f.ReadFrom(bytes.NewReader(data))
+  return
+}
@@ -0,0 +1,162 @@
+package bloomfilter
+
+import (
+  "encoding/binary"
+  "testing"
+)
+
+func TestCountingAddRemoveContains(t *testing.T) {
+  f := NewCounting(100000, 6, CounterWidth8)
+  for i := uint64(0); i < 500; i++ {
+    f.Add(testHashable(i))
+  }
+  for i := uint64(0); i < 500; i++ {
+    if !f.Contains(testHashable(i)) {
+      t.Fatalf("expected Contains(%d) to be true after Add", i)
+    }
+  }
+
+  f.Remove(testHashable(0))
+  if f.Contains(testHashable(0)) {
+    t.Fatal("expected Contains(0) to be false after Remove")
+  }
+}
+
+func TestCountingCount(t *testing.T) {
+  f := NewCounting(100000, 6, CounterWidth8)
+  f.Add(testHashable(0))
+  f.Add(testHashable(0))
+  f.Add(testHashable(0))
+
+  if got := f.Count(testHashable(0)); got != 3 {
+    t.Fatalf("expected Count to be 3 after three Adds, got %d", got)
+  }
+  if got := f.Count(testHashable(1)); got != 0 {
+    t.Fatalf("expected Count of a never-Added value to be 0, got %d", got)
+  }
+
+  f.Remove(testHashable(0))
+  if got := f.Count(testHashable(0)); got != 2 {
+    t.Fatalf("expected Count to be 2 after a Remove, got %d", got)
+  }
+}
+
+func TestCountingDecay(t *testing.T) {
+  f := NewCounting(100000, 6, CounterWidth8)
+  for i := 0; i < 6; i++ {
+    f.Add(testHashable(0))
+  }
+  if got := f.Count(testHashable(0)); got != 6 {
+    t.Fatalf("expected Count to be 6 before Decay, got %d", got)
+  }
+
+  f.Decay()
+  if got := f.Count(testHashable(0)); got != 3 {
+    t.Fatalf("expected Decay to halve the counters to 3, got %d", got)
+  }
+
+  f.Decay()
+  f.Decay()
+  if got := f.Count(testHashable(0)); got != 0 {
+    t.Fatalf("expected repeated Decay to age a counter out to 0, got %d", got)
+  }
+}
+
+func TestCountingToBloom(t *testing.T) {
+  f := NewCounting(100000, 6, CounterWidth8)
+  for i := uint64(0); i < 500; i++ {
+    f.Add(testHashable(i))
+  }
+
+  b := f.ToBloom()
+  if b.M() != f.M() || b.N() != f.N() {
+    t.Fatalf("expected ToBloom to preserve m/n: got (%d,%d), want (%d,%d)", b.M(), b.N(), f.M(), f.N())
+  }
+  for i := uint64(0); i < 500; i++ {
+    if !b.Contains(testHashable(i)) {
+      t.Fatalf("expected ToBloom result to Contain(%d)", i)
+    }
+  }
+
+  f.Remove(testHashable(0))
+  if f.Contains(testHashable(0)) {
+    t.Fatal("expected value to be gone after removing it as many times as it was added")
+  }
+  if f.ToBloom().Contains(testHashable(0)) {
+    t.Fatal("expected ToBloom to reflect a fully-removed counter as absent")
+  }
+}
+
+// TestCountingReadFromRejectsImplausibleWidth reproduces a crash found in
+// review: CountingFilter.ReadFrom sized its packed-counter allocation off
+// m*width straight from the wire, so a header with m within readFrameHeader's
+// bit-oriented bound but width == CounterWidth16 could still demand a
+// multi-gigabyte allocation before the checksum was ever checked.
+func TestCountingReadFromRejectsImplausibleWidth(t *testing.T) {
+  f := NewCounting(1000, 5, CounterWidth16)
+  data, err := f.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+
+  const mOffset = 4 + 2 + 1
+  binary.LittleEndian.PutUint64(data[mOffset:], maxAllowedM)
+
+  var got CountingFilter
+  if err := got.UnmarshalBinary(data); err != ErrFrameTooLarge {
+    t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+  }
+}
+
+// TestCountingReadFromRejectsImplausibleDecodedSize reproduces a gap found
+// in review: the packedLen bound in ReadFrom only covered the wire-packed
+// byte count, but unpackCounters always decodes into a []uint16 (2
+// bytes/counter) regardless of width, so an m that passed the packed-size
+// check could still demand up to 2x (CounterWidth8) or 4x (CounterWidth4)
+// the declared ceiling once decoded.
+func TestCountingReadFromRejectsImplausibleDecodedSize(t *testing.T) {
+  f := NewCounting(1000, 5, CounterWidth8)
+  data, err := f.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+
+  // m sits just under maxAllowedPackedBytes, so the packed (width 8, 1
+  // byte/counter) size alone would pass, but the decoded []uint16 form
+  // (2 bytes/counter) does not.
+  const mOffset = 4 + 2 + 1
+  binary.LittleEndian.PutUint64(data[mOffset:], maxAllowedPackedBytes-1)
+
+  var got CountingFilter
+  if err := got.UnmarshalBinary(data); err != ErrFrameTooLarge {
+    t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+  }
+}
+
+func TestCountingMarshalRoundTrip(t *testing.T) {
+  for _, width := range []uint8{CounterWidth4, CounterWidth8, CounterWidth16} {
+    f := NewCounting(100000, 6, width)
+    for i := uint64(0); i < 500; i++ {
+      f.Add(testHashable(i))
+    }
+
+    data, err := f.MarshalBinary()
+    if err != nil {
+      t.Fatalf("width %d: MarshalBinary: %v", width, err)
+    }
+
+    var got CountingFilter
+    if err := got.UnmarshalBinary(data); err != nil {
+      t.Fatalf("width %d: UnmarshalBinary: %v", width, err)
+    }
+    if got.Width() != width {
+      t.Fatalf("width %d: round-trip changed width to %d", width, got.Width())
+    }
+
+    for i := uint64(0); i < 500; i++ {
+      if !got.Contains(testHashable(i)) {
+        t.Fatalf("width %d: expected Contains(%d) to be true after round-trip", width, i)
+      }
+    }
+  }
+}
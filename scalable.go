@@ -0,0 +1,244 @@
+package bloomfilter
+
+// TODO stage compaction once older stages are entirely shadowed by newer ones
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "io"
+  "math"
+)
+
+const (
+  scalableDefaultGrowth    = 2.0    // m_i = m_0 * growth**i
+  scalableDefaultTightenBy = 0.9    // p_i = p_0 * tightenBy**i
+  scalableFillThreshold    = math.Ln2 // add a stage once a stage's fill ratio crosses this
+)
+
+// ScalableFilter is a Bloom filter that grows by appending new, larger
+// stages instead of requiring callers to pre-size m and k. Add always
+// inserts into the newest stage; Contains checks every stage. Each new
+// stage is sized (via OptimalM/OptimalK) for a larger expected capacity
+// and a tighter target false positive probability than the last. A new
+// stage is appended only once the newest stage's estimated fill ratio
+// reaches ln 2, and at that fill a stage's false positive probability is
+// well above its target, so the compounded FPP over all stages is not
+// bounded by p0 / (1 - tightenBy); FalsePosititveProbability reports the
+// compounded value from each stage's actual fill.
+//
+// See Almeida et al., "Scalable Bloom Filters".
+type ScalableFilter struct {
+  stages   []*Filter
+  n0       uint64
+  p0       float64
+  growth   float64
+  tightenBy float64
+}
+
+// n0 is the expected number of elements the first stage should hold
+//
+// p0 is the target false positive probability of the first stage
+func NewScalableFilter(n0 uint64, p0 float64) *ScalableFilter {
+  if n0 == 0 {
+    panic("n0 (expected capacity of the first stage) must be > 0")
+  }
+  if p0 <= 0 || p0 >= 1 {
+    panic("p0 (target false positive probability) must be in (0, 1)")
+  }
+  sf := &ScalableFilter{
+    n0:        n0,
+    p0:        p0,
+    growth:    scalableDefaultGrowth,
+    tightenBy: scalableDefaultTightenBy,
+  }
+  sf.addStage()
+  return sf
+}
+
+func (sf *ScalableFilter) addStage() {
+  i := float64(len(sf.stages))
+  capacity := uint64(math.Ceil(float64(sf.n0) * math.Pow(sf.growth, i)))
+  target := sf.p0 * math.Pow(sf.tightenBy, i)
+  m := OptimalM(capacity, target)
+  k := OptimalK(m, capacity)
+  sf.stages = append(sf.stages, New(m, k))
+}
+
+func (sf *ScalableFilter) Add(v Hashable) {
+  last := sf.stages[len(sf.stages)-1]
+  last.Add(v)
+  if estimatedFilledRatio(last) >= scalableFillThreshold {
+    sf.addStage()
+  }
+}
+
+// estimatedFilledRatio estimates a stage's fraction of set bits as
+// 1 - exp(-k*n/m), the standard closed-form estimate, instead of an
+// exhaustive popcount: Add calls this on every insert, so it must stay O(1).
+func estimatedFilledRatio(f *Filter) float64 {
+  return 1.0 - math.Exp(-float64(f.K())*float64(f.N())/float64(f.M()))
+}
+
+// false: definitely false
+// true:  maybe true or false
+func (sf ScalableFilter) Contains(v Hashable) bool {
+  for _, s := range sf.stages {
+    if s.Contains(v) {
+      return true
+    }
+  }
+  return false
+}
+
+// how many elements have been inserted, summed across all stages
+func (sf ScalableFilter) N() uint64 {
+  var n uint64
+  for _, s := range sf.stages {
+    n += s.N()
+  }
+  return n
+}
+
+func (sf ScalableFilter) Stages() int {
+  return len(sf.stages)
+}
+
+// Upper-bound of the compounded false positive probability across all stages
+func (sf ScalableFilter) FalsePosititveProbability() float64 {
+  // 1 - product(1 - p_i) over the stages, each already at its actual fill
+  prod := 1.0
+  for _, s := range sf.stages {
+    prod *= 1.0 - s.FalsePosititveProbability()
+  }
+  return 1.0 - prod
+}
+
+func (sf ScalableFilter) IsCompatible(sf2 ScalableFilter) bool {
+  if len(sf.stages) != len(sf2.stages) {
+    return false
+  }
+  for i := range sf.stages {
+    if !sf.stages[i].IsCompatible(*sf2.stages[i]) {
+      return false
+    }
+  }
+  return true
+}
+
+// Union only succeeds when both filters grew through the same sequence of
+// stages (same m/k/keys at each index); it is a pairwise Union of stages.
+func (sf ScalableFilter) Union(sf2 ScalableFilter) (out *ScalableFilter, err error) {
+  if !sf.IsCompatible(sf2) {
+    err = errors.New("Cannot combine incompatible scalable Bloom filters")
+    return
+  }
+  out = &ScalableFilter{
+    n0:        sf.n0,
+    p0:        sf.p0,
+    growth:    sf.growth,
+    tightenBy: sf.tightenBy,
+    stages:    make([]*Filter, len(sf.stages)),
+  }
+  for i := range sf.stages {
+    out.stages[i], err = sf.stages[i].Union(*sf2.stages[i])
+    if err != nil {
+      return
+    }
+  }
+  return
+}
+
+// marshalled binary layout:
+//
+//   n0        uint64
+//   p0        float64
+//   growth    float64
+//   tightenBy float64
+//   numStages uint32
+//   for each stage:
+//     len(stage) uint32
+//     stage (see Filter.WriteTo)
+//
+func (sf ScalableFilter) MarshalBinary() (data []byte, err error) {
+  buf := new(bytes.Buffer)
+
+  for _, field := range []interface{}{sf.n0, sf.p0, sf.growth, sf.tightenBy} {
+    if err = binary.Write(buf, binary.LittleEndian, field); err != nil {
+      return
+    }
+  }
+
+  err = binary.Write(buf, binary.LittleEndian, uint32(len(sf.stages)))
+  if err != nil {
+    return
+  }
+
+  for _, s := range sf.stages {
+    var stageData []byte
+    stageData, err = s.MarshalBinary()
+    if err != nil {
+      return
+    }
+    err = binary.Write(buf, binary.LittleEndian, uint32(len(stageData)))
+    if err != nil {
+      return
+    }
+    if _, err = buf.Write(stageData); err != nil {
+      return
+    }
+  }
+
+  data = buf.Bytes()
+  return
+}
+
+func (sf *ScalableFilter) UnmarshalBinary(data []byte) (err error) {
+  buf := bytes.NewReader(data)
+
+  for _, field := range []interface{}{&sf.n0, &sf.p0, &sf.growth, &sf.tightenBy} {
+    if err = binary.Read(buf, binary.LittleEndian, field); err != nil {
+      return
+    }
+  }
+
+  var numStages uint32
+  err = binary.Read(buf, binary.LittleEndian, &numStages)
+  if err != nil {
+    return
+  }
+  // A stage is at least 4 bytes (its length prefix) on the wire, so a
+  // numStages that can't possibly fit in what's left is corrupt; this also
+  // keeps make([]*Filter, numStages) below from OOMing on a bogus count.
+  if uint64(numStages) > uint64(buf.Len())/4 {
+    err = ErrFrameTooLarge
+    return
+  }
+
+  stages := make([]*Filter, numStages)
+  for i := range stages {
+    var size uint32
+    if err = binary.Read(buf, binary.LittleEndian, &size); err != nil {
+      return
+    }
+    // Bound the stage size against what's actually left in the buffer
+    // before allocating for it, so a corrupted/crafted size can't OOM the
+    // process ahead of ever validating the stage's own checksum.
+    if uint64(size) > uint64(buf.Len()) {
+      err = ErrFrameTooLarge
+      return
+    }
+    stageData := make([]byte, size)
+    if _, err = io.ReadFull(buf, stageData); err != nil {
+      return
+    }
+    stage := &Filter{}
+    if err = stage.UnmarshalBinary(stageData); err != nil {
+      return
+    }
+    stages[i] = stage
+  }
+
+  sf.stages = stages
+  return nil
+}
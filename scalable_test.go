@@ -0,0 +1,113 @@
+package bloomfilter
+
+import (
+  "encoding/binary"
+  "testing"
+)
+
+func TestScalableGrowsAndContains(t *testing.T) {
+  sf := NewScalableFilter(100, 0.01)
+  for i := uint64(0); i < 5000; i++ {
+    sf.Add(testHashable(i))
+  }
+  for i := uint64(0); i < 5000; i++ {
+    if !sf.Contains(testHashable(i)) {
+      t.Fatalf("expected Contains(%d) to be true after Add", i)
+    }
+  }
+  if sf.Stages() <= 1 {
+    t.Fatalf("expected inserting past n0 to grow new stages, got %d stage(s)", sf.Stages())
+  }
+}
+
+func TestScalableUnion(t *testing.T) {
+  seed := NewScalableFilter(100, 0.01)
+
+  // b starts as an exact (same-keys) copy of the untouched seed via a
+  // marshal round-trip, since IsCompatible requires matching per-stage
+  // keys, not just matching shape - two independently constructed
+  // ScalableFilters never match. Both then see the same number of Adds, so
+  // their count-driven stage growth stays in lockstep.
+  data, err := seed.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+  a := seed
+  var b ScalableFilter
+  if err := b.UnmarshalBinary(data); err != nil {
+    t.Fatalf("UnmarshalBinary: %v", err)
+  }
+
+  for i := uint64(0); i < 50; i++ {
+    a.Add(testHashable(i))
+    b.Add(testHashable(i + 50))
+  }
+
+  if !a.IsCompatible(b) {
+    t.Fatal("expected a and its same-keys copy to be compatible after identical-count growth")
+  }
+
+  out, err := a.Union(b)
+  if err != nil {
+    t.Fatalf("Union: %v", err)
+  }
+  for i := uint64(0); i < 100; i++ {
+    if !out.Contains(testHashable(i)) {
+      t.Fatalf("expected Union to contain %d", i)
+    }
+  }
+}
+
+func TestScalableMarshalRoundTrip(t *testing.T) {
+  sf := NewScalableFilter(100, 0.01)
+  for i := uint64(0); i < 5000; i++ {
+    sf.Add(testHashable(i))
+  }
+
+  data, err := sf.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+
+  var got ScalableFilter
+  if err := got.UnmarshalBinary(data); err != nil {
+    t.Fatalf("UnmarshalBinary: %v", err)
+  }
+  if got.Stages() != sf.Stages() {
+    t.Fatalf("round-trip changed stage count: got %d, want %d", got.Stages(), sf.Stages())
+  }
+  for i := uint64(0); i < 5000; i++ {
+    if !got.Contains(testHashable(i)) {
+      t.Fatalf("expected Contains(%d) to be true after round-trip", i)
+    }
+  }
+}
+
+// TestScalableUnmarshalRejectsImplausibleEnvelope reproduces a crash found
+// in review: a crafted numStages/size in the outer envelope used to be
+// make()'d straight off the wire, OOMing the process before the nested
+// per-stage Filter ever got a chance to fail its own checksum.
+func TestScalableUnmarshalRejectsImplausibleEnvelope(t *testing.T) {
+  sf := NewScalableFilter(100, 0.01)
+  data, err := sf.MarshalBinary()
+  if err != nil {
+    t.Fatalf("MarshalBinary: %v", err)
+  }
+
+  // n0, p0, growth, tightenBy = 8 + 8*3 = 32 bytes, then numStages uint32.
+  const numStagesOffset = 32
+
+  corruptNumStages := append([]byte(nil), data...)
+  binary.LittleEndian.PutUint32(corruptNumStages[numStagesOffset:], 0xFFFFFFFF)
+  var got ScalableFilter
+  if err := got.UnmarshalBinary(corruptNumStages); err != ErrFrameTooLarge {
+    t.Fatalf("expected ErrFrameTooLarge for a bogus numStages, got %v", err)
+  }
+
+  corruptSize := append([]byte(nil), data...)
+  const firstStageSizeOffset = numStagesOffset + 4
+  binary.LittleEndian.PutUint32(corruptSize[firstStageSizeOffset:], 0xFFFFFFFF)
+  if err := got.UnmarshalBinary(corruptSize); err != ErrFrameTooLarge {
+    t.Fatalf("expected ErrFrameTooLarge for a bogus stage size, got %v", err)
+  }
+}
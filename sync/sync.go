@@ -0,0 +1,164 @@
+// Package sync wraps a *bloomfilter.Filter for streaming set reconciliation:
+// a background goroutine rebuilds the filter from a fresh source once it
+// grows past a configured size or false positive rate. Lookups wait on that
+// rebuild only while it holds the lock to install its shadow filter and to
+// merge and swap in the rebuilt filter, not while it reads the source.
+package sync
+
+// TODO surface rebuild failures/metrics instead of silently retrying next tick
+
+import (
+  "context"
+  stdsync "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/JustinOhms/bloomfilter"
+)
+
+// Iterator yields the elements a rebuild should insert into a fresh filter.
+type Iterator interface {
+  // Next returns the next element, or ok == false once exhausted.
+  Next() (v bloomfilter.Hashable, ok bool)
+}
+
+// SyncFilter is a concurrency-safe, rebuildable wrapper around a
+// *bloomfilter.Filter.
+type SyncFilter struct {
+  cur    atomic.Pointer[bloomfilter.Filter]
+  shadow atomic.Pointer[bloomfilter.Filter] // non-nil only while a rebuild is in flight
+  mu     stdsync.RWMutex                    // guards cur/shadow against concurrent mutation and the rebuild swap
+
+  maxN      uint64
+  maxFPP    float64
+  newFilter func() *bloomfilter.Filter
+
+  rebuilding int32
+}
+
+// initial is the filter to serve lookups from until the first rebuild.
+//
+// maxN is the element count past which a rebuild is triggered (0 disables this trigger).
+//
+// maxFPP is the false positive probability past which a rebuild is triggered (0 disables this trigger).
+//
+// newFilter builds an empty filter of the size/shape a rebuild should produce.
+func New(initial *bloomfilter.Filter, maxN uint64, maxFPP float64, newFilter func() *bloomfilter.Filter) *SyncFilter {
+  sf := &SyncFilter{
+    maxN:      maxN,
+    maxFPP:    maxFPP,
+    newFilter: newFilter,
+  }
+  sf.cur.Store(initial)
+  return sf
+}
+
+func (sf *SyncFilter) Add(v bloomfilter.Hashable) {
+  sf.mu.Lock()
+  defer sf.mu.Unlock()
+  sf.cur.Load().Add(v)
+  if shadow := sf.shadow.Load(); shadow != nil {
+    shadow.Add(v)
+  }
+}
+
+// false: definitely false
+// true:  maybe true or false
+func (sf *SyncFilter) Contains(v bloomfilter.Hashable) bool {
+  sf.mu.RLock()
+  defer sf.mu.RUnlock()
+  return sf.cur.Load().Contains(v)
+}
+
+func (sf *SyncFilter) N() uint64 {
+  sf.mu.RLock()
+  defer sf.mu.RUnlock()
+  return sf.cur.Load().N()
+}
+
+// Prefetch issues best-effort cache-warming reads for a batch of upcoming
+// lookups, given their raw probe positions (bloomfilter.Filter.Positions),
+// so bulk membership queries on large filters avoid cache stalls. See
+// Filter.Touch.
+func (sf *SyncFilter) Prefetch(hashes []uint64) {
+  sf.mu.RLock()
+  defer sf.mu.RUnlock()
+  f := sf.cur.Load()
+  for _, h := range hashes {
+    f.Touch(h)
+  }
+}
+
+func (sf *SyncFilter) needsRebuild() bool {
+  sf.mu.RLock()
+  defer sf.mu.RUnlock()
+  f := sf.cur.Load()
+  if sf.maxN > 0 && f.N() > sf.maxN {
+    return true
+  }
+  if sf.maxFPP > 0 && f.FalsePosititveProbability() >= sf.maxFPP {
+    return true
+  }
+  return false
+}
+
+// Start runs until ctx is done, checking every checkEvery whether the
+// filter needs rebuilding and, when it does, rebuilding it from a fresh
+// Iterator produced by source. Inserts that arrive while a rebuild is in
+// flight go into a shadow filter (via Add) that gets unioned into the
+// freshly-built filter at swap time ("warm handoff"), so no insert made
+// during a rebuild is lost.
+func (sf *SyncFilter) Start(ctx context.Context, source func() Iterator, checkEvery time.Duration) {
+  ticker := time.NewTicker(checkEvery)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if sf.needsRebuild() {
+        sf.rebuild(source)
+      }
+    }
+  }
+}
+
+func (sf *SyncFilter) rebuild(source func() Iterator) {
+  if !atomic.CompareAndSwapInt32(&sf.rebuilding, 0, 1) {
+    return // a rebuild is already in flight
+  }
+  defer atomic.StoreInt32(&sf.rebuilding, 0)
+
+  fresh := sf.newFilter()
+
+  // Install an empty copy of fresh as the shadow *before* calling source,
+  // not just before populating fresh: source() itself takes a snapshot of
+  // the data fresh will be built from, and any Add landing between that
+  // snapshot and the shadow install would otherwise go only into cur, which
+  // is discarded wholesale once fresh is swapped in.
+  sf.mu.Lock()
+  sf.shadow.Store(fresh.Copy())
+  sf.mu.Unlock()
+
+  it := source()
+  for {
+    v, ok := it.Next()
+    if !ok {
+      break
+    }
+    fresh.Add(v)
+  }
+
+  // Hold the lock across draining the shadow and installing fresh as cur:
+  // otherwise an Add arriving between those two steps would see a nil
+  // shadow and a not-yet-swapped cur, and its insert would go into the
+  // about-to-be-discarded old filter only.
+  sf.mu.Lock()
+  shadow := sf.shadow.Load()
+  if merged, err := fresh.Union(*shadow); err == nil {
+    fresh = merged
+  }
+  sf.shadow.Store(nil)
+  sf.cur.Store(fresh)
+  sf.mu.Unlock()
+}